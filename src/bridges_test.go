@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestParseBridgeLine(t *testing.T) {
+	tests := []struct {
+		name        string
+		line        string
+		wantErr     bool
+		fingerprint string
+		address     string
+		transport   string
+	}{
+		{
+			name:        "with Bridge prefix",
+			line:        "Bridge obfs4 192.0.2.1:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=abc iat-mode=0",
+			fingerprint: "0123456789ABCDEF0123456789ABCDEF01234567",
+			address:     "192.0.2.1:443",
+			transport:   "obfs4",
+		},
+		{
+			name:        "without Bridge prefix",
+			line:        "webtunnel [2001:db8::1]:443 FEDCBA9876543210FEDCBA9876543210FEDCBA98 url=https://example.com/",
+			fingerprint: "FEDCBA9876543210FEDCBA9876543210FEDCBA98",
+			address:     "[2001:db8::1]:443",
+			transport:   "webtunnel",
+		},
+		{
+			name:    "too few fields",
+			line:    "Bridge obfs4 192.0.2.1:443",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay, err := parseBridgeLine(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseBridgeLine(%q) returned nil error, want one", tt.line)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseBridgeLine(%q) returned error: %v", tt.line, err)
+			}
+			if relay.Fingerprint != tt.fingerprint {
+				t.Errorf("Fingerprint = %q, want %q", relay.Fingerprint, tt.fingerprint)
+			}
+			if len(relay.OrAddresses) != 1 || relay.OrAddresses[0] != tt.address {
+				t.Errorf("OrAddresses = %v, want [%q]", relay.OrAddresses, tt.address)
+			}
+			if relay.Transport != tt.transport {
+				t.Errorf("Transport = %q, want %q", relay.Transport, tt.transport)
+			}
+			if relay.Country != "" {
+				t.Errorf("Country = %q, want empty (BridgeDB lines carry no country)", relay.Country)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestCircuitBuilt(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []string
+		circuitID string
+		want      bool
+	}{
+		{
+			name:      "built circuit matches by id",
+			data:      []string{"12 BUILT $AAAA...,$BBBB... PURPOSE=GENERAL"},
+			circuitID: "12",
+			want:      true,
+		},
+		{
+			name:      "circuit present but not yet built",
+			data:      []string{"12 EXTENDED $AAAA...,$BBBB... PURPOSE=GENERAL"},
+			circuitID: "12",
+			want:      false,
+		},
+		{
+			name:      "different circuit id is built",
+			data:      []string{"7 BUILT $CCCC..."},
+			circuitID: "12",
+			want:      false,
+		},
+		{
+			name:      "multiple circuits, ours built",
+			data:      []string{"7 EXTENDED $CCCC...", "12 BUILT $AAAA...,$BBBB..."},
+			circuitID: "12",
+			want:      true,
+		},
+		{
+			name:      "empty data",
+			data:      nil,
+			circuitID: "12",
+			want:      false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := circuitBuilt(tt.data, tt.circuitID); got != tt.want {
+				t.Errorf("circuitBuilt(%v, %q) = %v, want %v", tt.data, tt.circuitID, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bufio"
+	"container/list"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
@@ -12,18 +15,31 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"git.openprivacy.ca/openprivacy/bine/tor"
 )
 
 // Relay represents a Tor Relay with its details
 type Relay struct {
-	Fingerprint string   `json:"fingerprint"`
-	OrAddresses []string `json:"or_addresses"`
-	Country     string   `json:"country"`
-	Reachable   []string // Populated after checking
+	Fingerprint string          `json:"fingerprint"`
+	OrAddresses []string        `json:"or_addresses"`
+	Country     string          `json:"country"`
+	Transport   string          // Pluggable transport name (e.g. "obfs4"), empty for vanilla relays
+	BridgeLine  string          // Full "transport addr fp k=v..." line as published by BridgeDB, if any
+	Reachable   []ReachableAddr // Populated after checking
+}
+
+// ReachableAddr records an address that answered, along with how long it took
+type ReachableAddr struct {
+	Address string
+	RTT     time.Duration
 }
 
 // RelayResponse represents the JSON structure from onionoo
@@ -53,8 +69,8 @@ func logPrintln(v ...interface{}) {
 	logger.Println(v...)
 }
 
-// loadRelays downloads relay data from specified URLs with proxy and CORS support
-func loadRelays(urls []string, timeout time.Duration, proxy string) ([]Relay, error) {
+// newHTTPClient builds an http.Client honoring the optional proxy URL
+func newHTTPClient(timeout time.Duration, proxy string) (*http.Client, error) {
 	client := &http.Client{Timeout: timeout}
 	if proxy != "" {
 		proxyURL, err := url.Parse(proxy)
@@ -65,10 +81,32 @@ func loadRelays(urls []string, timeout time.Duration, proxy string) ([]Relay, er
 			Proxy: http.ProxyURL(proxyURL),
 		}
 	}
+	return client, nil
+}
+
+// loadRelays downloads relay or bridge data depending on bridgeType.
+// When bridgeType is non-empty it dispatches to loadBridges instead of onionoo.
+// ctx bounds every HTTP request it issues; cancellation aborts the download.
+func loadRelays(ctx context.Context, urls []string, timeout time.Duration, proxy string, bridgeType string) ([]Relay, error) {
+	if bridgeType != "" {
+		return loadBridges(ctx, bridgeType, timeout, proxy)
+	}
+
+	client, err := newHTTPClient(timeout, proxy)
+	if err != nil {
+		return nil, err
+	}
 
 	for _, u := range urls {
-		resp, err := client.Get(u)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
 			logPrint("Can't download Tor Relay data from %s: %v\n", u, err)
 			continue
 		}
@@ -85,31 +123,308 @@ func loadRelays(urls []string, timeout time.Duration, proxy string) ([]Relay, er
 	return nil, fmt.Errorf("failed to download relay data from all URLs")
 }
 
-// checkRelay tests if a relay address is reachable and writes to file immediately
-func checkRelay(address string, timeout time.Duration, results chan<- struct {
-	Address string
-	Relay   *Relay
-}, wg *sync.WaitGroup, relay *Relay, file *os.File, mu *sync.Mutex) {
-	defer wg.Done()
-	conn, err := net.DialTimeout("tcp", address, timeout)
-	if err == nil {
-		if tcpConn, ok := conn.(*net.TCPConn); ok {
+// bridgeDBMoatBuiltinURL is BridgeDB's moat "builtin" endpoint: a plain,
+// no-auth GET (no query string) returning every transport's default bridge
+// lines as a flat {transport: [line, ...]} JSON object, the same set Tor
+// Browser ships built in. It doesn't require the captcha-gated web UI or the
+// POST-based country-targeted moat/circumvention settings flow.
+const bridgeDBMoatBuiltinURL = "https://bridges.torproject.org/moat/circumvention/builtin"
+
+// loadBridges fetches obfs4/webtunnel/snowflake bridge lines from BridgeDB's
+// moat builtin endpoint and parses bridgeType's entries into Relay values.
+// ctx bounds the HTTP request.
+func loadBridges(ctx context.Context, bridgeType string, timeout time.Duration, proxy string) ([]Relay, error) {
+	client, err := newHTTPClient(timeout, proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, bridgeDBMoatBuiltinURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("can't download bridge data from %s: %v", bridgeDBMoatBuiltinURL, err)
+	}
+	defer resp.Body.Close()
+
+	var data map[string][]string
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON from %s: %v", bridgeDBMoatBuiltinURL, err)
+	}
+
+	var bridges []Relay
+	for _, line := range data[bridgeType] {
+		bridge, err := parseBridgeLine(line)
+		if err != nil {
+			logPrint("Skipping malformed bridge line: %v\n", err)
+			continue
+		}
+		bridges = append(bridges, bridge)
+	}
+	if len(bridges) == 0 {
+		return nil, fmt.Errorf("no usable %s bridges returned by %s", bridgeType, bridgeDBMoatBuiltinURL)
+	}
+	logPrint("Successfully loaded %d %s bridges from %s\n", len(bridges), bridgeType, bridgeDBMoatBuiltinURL)
+	return bridges, nil
+}
+
+// parseBridgeLine parses a "Bridge obfs4 IP:PORT FINGERPRINT cert=... iat-mode=..."
+// style line (the leading "Bridge " keyword is optional) into a Relay.
+// BridgeDB bridge lines carry no country field, so Relay.Country is always
+// left empty; combining -bridge-type with -c or -per-country-max therefore
+// buckets every bridge together instead of diversifying by country:
+// -per-country-max caps the total, and an exclusive ("!") -c entry matches no
+// bridge at all.
+func parseBridgeLine(line string) (Relay, error) {
+	line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "Bridge "))
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return Relay{}, fmt.Errorf("expected \"transport addr fingerprint ...\", got %q", line)
+	}
+	return Relay{
+		Fingerprint: fields[2],
+		OrAddresses: []string{fields[1]},
+		Transport:   fields[0],
+		BridgeLine:  line,
+	}, nil
+}
+
+// Dialer is the minimal dialing interface checkRelay needs. It lets probes be
+// sent either directly or through a SOCKS5 proxy, e.g. a local Tor client, so
+// the scanner can run from behind a censor.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// newDialer returns a direct dialer, or one that proxies through socksAddr
+// (host:port) via an unauthenticated SOCKS5 CONNECT when socksAddr is set.
+func newDialer(socksAddr string) Dialer {
+	if socksAddr == "" {
+		return &net.Dialer{}
+	}
+	return &socks5Dialer{proxyAddr: socksAddr}
+}
+
+// socks5Dialer tunnels dials through an unauthenticated SOCKS5 proxy.
+type socks5Dialer struct {
+	proxyAddr string
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, d.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dial SOCKS5 proxy %s: %v", d.proxyAddr, err)
+	}
+	if err := socks5Connect(conn, address); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// socks5Connect performs a no-auth SOCKS5 CONNECT handshake for address over conn.
+func socks5Connect(conn net.Conn, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", address, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid port %q: %v", portStr, err)
+	}
+
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		return err
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		return err
+	}
+	if method[0] != 0x05 || method[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 proxy rejected no-auth method (got %v)", method)
+	}
+
+	req := append([]byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}, host...)
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 CONNECT to %s failed with code %d", address, reply[1])
+	}
+	var skip int64
+	switch reply[3] {
+	case 0x01: // IPv4
+		skip = net.IPv4len + 2
+	case 0x04: // IPv6
+		skip = net.IPv6len + 2
+	case 0x03: // domain name, length-prefixed
+		lenBuf := make([]byte, 1)
+		if _, err := io.ReadFull(conn, lenBuf); err != nil {
+			return err
+		}
+		skip = int64(lenBuf[0]) + 2
+	default:
+		return fmt.Errorf("unknown SOCKS5 address type %d in reply", reply[3])
+	}
+	_, err = io.CopyN(io.Discard, conn, skip)
+	return err
+}
+
+// CircuitVerifier rules out TCP-reachable-but-not-really-Tor false positives by
+// building a real one-hop circuit through a candidate relay via an embedded tor
+// process managed with bine, and only confirming relays that complete it.
+type CircuitVerifier struct {
+	t       *tor.Tor
+	timeout time.Duration
+}
+
+// newCircuitVerifier starts an embedded tor instance rooted at dataDir and
+// waits for it to bootstrap. tor.Start launches tor with --DisableNetwork 1
+// by default, so without EnableNetwork it would never fetch a consensus or
+// descriptors and EXTENDCIRCUIT would hang or fail for every relay.
+func newCircuitVerifier(ctx context.Context, dataDir string, timeout time.Duration) (*CircuitVerifier, error) {
+	t, err := tor.Start(ctx, &tor.StartConf{DataDir: dataDir, NoAutoSocksPort: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start embedded tor: %v", err)
+	}
+	if err := t.EnableNetwork(ctx, true); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("failed to bootstrap embedded tor: %v", err)
+	}
+	return &CircuitVerifier{t: t, timeout: timeout}, nil
+}
+
+// Verify asks the embedded tor's control port to extend a fresh one-hop circuit
+// through fingerprint, returning nil only once that circuit actually builds.
+func (v *CircuitVerifier) Verify(ctx context.Context, fingerprint string) error {
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+
+	resp, err := v.t.Control.SendRequest("EXTENDCIRCUIT 0 $%s", fingerprint)
+	if err != nil {
+		return fmt.Errorf("failed to extend circuit through %s: %v", fingerprint, err)
+	}
+	var circuitID string
+	if _, err := fmt.Sscanf(resp.Reply, "EXTENDED %s", &circuitID); err != nil {
+		return fmt.Errorf("unexpected EXTENDCIRCUIT reply for %s: %q", fingerprint, resp.Reply)
+	}
+
+	for {
+		status, err := v.t.Control.SendRequest("GETINFO circuit-status")
+		if err != nil {
+			return fmt.Errorf("failed to query circuit status: %v", err)
+		}
+		if circuitBuilt(status.Data, circuitID) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("circuit through %s did not build within %s", fingerprint, v.timeout)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// Close shuts down the embedded tor instance.
+func (v *CircuitVerifier) Close() error {
+	return v.t.Close()
+}
+
+// circuitBuilt reports whether data, the Data lines of a "GETINFO
+// circuit-status" response, shows circuitID in the BUILT state. GETINFO
+// circuit-status is a dot-encoded multi-line reply, so the circuit list lives
+// in Response.Data; Response.Reply is just the trailing "OK".
+func circuitBuilt(data []string, circuitID string) bool {
+	for _, line := range data {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == circuitID && fields[1] == "BUILT" {
+			return true
+		}
+	}
+	return false
+}
+
+// probeAddress dials address probeCount times (at least once), one dial after
+// another, and returns the median RTT of the dials that succeeded; ok is false
+// if every dial failed.
+// Dialing several times and taking the median smooths out one-off network blips
+// so latency-based ranking in selectBest isn't skewed by a single slow dial.
+func probeAddress(ctx context.Context, dialer Dialer, address string, timeout time.Duration, probeCount int) (median time.Duration, ok bool) {
+	if probeCount < 1 {
+		probeCount = 1
+	}
+	var rtts []time.Duration
+	for i := 0; i < probeCount; i++ {
+		dialCtx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		conn, err := dialer.DialContext(dialCtx, "tcp", address)
+		cancel()
+		if err != nil {
+			continue
+		}
+		rtts = append(rtts, time.Since(start))
+		if tcpConn, isTCP := conn.(*net.TCPConn); isTCP {
 			tcpConn.SetLinger(0)
 		}
 		conn.Close()
-		// Write to file immediately
-		line := fmt.Sprintf("%s %s\n", address, relay.Fingerprint)
-		mu.Lock()
-		file.WriteString(line)
-		mu.Unlock()
-		// Send result to channel
-		results <- struct {
-			Address string
-			Relay   *Relay
-		}{address, relay}
-	} else {
-		logPrint("Failed to connect to %s: %v\n", address, err)
 	}
+	if len(rtts) == 0 {
+		return 0, false
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	return rtts[len(rtts)/2], true
+}
+
+// checkRelay tests if a relay address is reachable (optionally confirming it with
+// a real Tor circuit via verifier) and writes it to file immediately. ctx bounds
+// every dial: cancellation or the per-dial timeout, whichever comes first, aborts
+// the in-flight Dialer.DialContext call.
+func checkRelay(ctx context.Context, dialer Dialer, verifier *CircuitVerifier, address string, timeout time.Duration, probeCount int, results chan<- struct {
+	Address string
+	RTT     time.Duration
+	Relay   *Relay
+}, relay *Relay, file *os.File, mu *sync.Mutex) {
+	rtt, ok := probeAddress(ctx, dialer, address, timeout, probeCount)
+	if !ok {
+		logPrint("Failed to connect to %s\n", address)
+		return
+	}
+
+	if verifier != nil {
+		if err := verifier.Verify(ctx, relay.Fingerprint); err != nil {
+			logPrint("Circuit verification failed for %s (%s): %v\n", address, relay.Fingerprint, err)
+			return
+		}
+	}
+
+	// Write to file immediately, preserving the full transport line for bridges
+	line := relayLine(address, relay) + "\n"
+	mu.Lock()
+	file.WriteString(line)
+	mu.Unlock()
+	// Send result to channel
+	results <- struct {
+		Address string
+		RTT     time.Duration
+		Relay   *Relay
+	}{address, rtt, relay}
+}
+
+// relayLine formats the line written to _bridges.txt and generateOutput for a
+// reachable address: the raw BridgeDB line for pluggable-transport bridges, or
+// the plain "address fingerprint" pair for vanilla relays.
+func relayLine(address string, relay *Relay) string {
+	if relay.Transport != "" && relay.BridgeLine != "" {
+		return relay.BridgeLine
+	}
+	return fmt.Sprintf("%s %s", address, relay.Fingerprint)
 }
 
 // parseAddress splits address into host and port, handling IPv6
@@ -129,8 +444,15 @@ func parseAddress(addr string) (string, string) {
 	return host, port
 }
 
-// filterAndSortRelays applies country and port filters
-func filterAndSortRelays(relays []Relay, preferredCountry string, ports []string) []Relay {
+// addrIsIPv6 reports whether addr's host is an IPv6 literal
+func addrIsIPv6(addr string) bool {
+	host, _ := parseAddress(addr)
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// filterAndSortRelays applies country, port and address-family filters
+func filterAndSortRelays(relays []Relay, preferredCountry string, ports []string, ipv4Only, ipv6Only bool) []Relay {
 	var onlyCountries, excludeCountries, sortedCountries map[string]int
 	if preferredCountry != "" {
 		onlyCountries = make(map[string]int)
@@ -176,6 +498,19 @@ func filterAndSortRelays(relays []Relay, preferredCountry string, ports []string
 			}
 			r.OrAddresses = newAddrs
 		}
+
+		if ipv4Only || ipv6Only {
+			var newAddrs []string
+			for _, addr := range r.OrAddresses {
+				if addrIsIPv6(addr) == ipv6Only {
+					newAddrs = append(newAddrs, addr)
+				}
+			}
+			if len(newAddrs) == 0 {
+				continue
+			}
+			r.OrAddresses = newAddrs
+		}
 		filtered = append(filtered, r)
 	}
 
@@ -196,26 +531,236 @@ func filterAndSortRelays(relays []Relay, preferredCountry string, ports []string
 	return filtered
 }
 
-// generateOutput writes the relay configuration to outfile
-func generateOutput(workingRelays []Relay, torrcFmt bool, prefsjs string, outfile *os.File) error {
-	prefix := ""
-	if torrcFmt {
-		prefix = "Bridge "
+// jsonRelay is one entry of the -json output array
+type jsonRelay struct {
+	Fingerprint string `json:"fingerprint"`
+	Address     string `json:"address"`
+	Country     string `json:"country"`
+	RTTMillis   int64  `json:"rtt_ms"`
+}
+
+// PoolEntry is one reachable relay/bridge address held by a RelayPool, as served
+// over HTTP in -serve mode.
+type PoolEntry struct {
+	Fingerprint string
+	Address     string
+	Country     string
+	Line        string // relayLine(Address, relay): what gets written to torrc/_bridges.txt
+	RTT         time.Duration
+	LastSeen    time.Time
+}
+
+// PoolStats summarizes a RelayPool for /status and /metrics.
+type PoolStats struct {
+	Tested       int64
+	Reachable    int64
+	PerCountry   map[string]int64
+	AvgRTTMillis float64
+}
+
+// RelayPool is a mutex-guarded, size-bounded LRU of reachable relays/bridges fed
+// by the background rescanner in -serve mode and read by the HTTP handlers.
+// Putting an already-known fingerprint+address pair refreshes it to the front
+// instead of duplicating it; once maxSize is exceeded the least-recently-seen
+// entry is evicted.
+type RelayPool struct {
+	mu       sync.Mutex
+	maxSize  int
+	ll       *list.List
+	elements map[string]*list.Element
+
+	tested     int64
+	perCountry map[string]int64
+	rttTotalMs int64
+	rttCount   int64
+}
+
+// NewRelayPool creates an empty pool. maxSize <= 0 means unbounded.
+func NewRelayPool(maxSize int) *RelayPool {
+	return &RelayPool{
+		maxSize:    maxSize,
+		ll:         list.New(),
+		elements:   make(map[string]*list.Element),
+		perCountry: make(map[string]int64),
 	}
+}
+
+func poolKey(e PoolEntry) string {
+	return e.Fingerprint + " " + e.Address
+}
 
-	writer := bufio.NewWriter(outfile)
+// Put inserts or refreshes e, evicting the least-recently-seen entry if the
+// pool is now over maxSize.
+func (p *RelayPool) Put(e PoolEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	for _, r := range workingRelays {
-		for _, addr := range r.Reachable {
-			line := fmt.Sprintf("%s%s %s\n", prefix, addr, r.Fingerprint)
-			fmt.Fprint(writer, line)
-			logPrint("Added to output: %s", line)
+	key := poolKey(e)
+	if el, ok := p.elements[key]; ok {
+		p.ll.MoveToFront(el)
+		el.Value = &e
+	} else {
+		el := p.ll.PushFront(&e)
+		p.elements[key] = el
+		p.perCountry[e.Country]++
+		if p.maxSize > 0 && p.ll.Len() > p.maxSize {
+			p.evictOldest()
 		}
 	}
-	if torrcFmt {
-		fmt.Fprintln(writer, "UseBridges 1")
+	p.rttTotalMs += e.RTT.Milliseconds()
+	p.rttCount++
+}
+
+// evictOldest drops the least-recently-seen entry. Caller must hold p.mu.
+func (p *RelayPool) evictOldest() {
+	el := p.ll.Back()
+	if el == nil {
+		return
+	}
+	p.ll.Remove(el)
+	entry := el.Value.(*PoolEntry)
+	delete(p.elements, poolKey(*entry))
+	p.perCountry[entry.Country]--
+}
+
+// RecordTested adds n to the running count of relay addresses probed, whether
+// or not they turned out reachable.
+func (p *RelayPool) RecordTested(n int64) {
+	p.mu.Lock()
+	p.tested += n
+	p.mu.Unlock()
+}
+
+// Snapshot returns the pool's current entries, most-recently-seen first.
+func (p *RelayPool) Snapshot() []PoolEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]PoolEntry, 0, p.ll.Len())
+	for el := p.ll.Front(); el != nil; el = el.Next() {
+		out = append(out, *el.Value.(*PoolEntry))
+	}
+	return out
+}
+
+// Stats reports pool-wide counters for /status and /metrics.
+func (p *RelayPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var avgRTT float64
+	if p.rttCount > 0 {
+		avgRTT = float64(p.rttTotalMs) / float64(p.rttCount)
+	}
+	perCountry := make(map[string]int64, len(p.perCountry))
+	for k, v := range p.perCountry {
+		if v > 0 {
+			perCountry[k] = v
+		}
+	}
+	return PoolStats{
+		Tested:       p.tested,
+		Reachable:    int64(p.ll.Len()),
+		PerCountry:   perCountry,
+		AvgRTTMillis: avgRTT,
+	}
+}
+
+// WritePrometheus writes pool stats in Prometheus text exposition format.
+func (p *RelayPool) WritePrometheus(w io.Writer) {
+	stats := p.Stats()
+	fmt.Fprintln(w, "# HELP torbridges_relays_tested_total Relay/bridge addresses probed since start")
+	fmt.Fprintln(w, "# TYPE torbridges_relays_tested_total counter")
+	fmt.Fprintf(w, "torbridges_relays_tested_total %d\n", stats.Tested)
+	fmt.Fprintln(w, "# HELP torbridges_relays_reachable Reachable relays/bridges currently held in the pool")
+	fmt.Fprintln(w, "# TYPE torbridges_relays_reachable gauge")
+	fmt.Fprintf(w, "torbridges_relays_reachable %d\n", stats.Reachable)
+	fmt.Fprintln(w, "# HELP torbridges_reachable_by_country Reachable relays/bridges in the pool, by country")
+	fmt.Fprintln(w, "# TYPE torbridges_reachable_by_country gauge")
+	for country, n := range stats.PerCountry {
+		fmt.Fprintf(w, "torbridges_reachable_by_country{country=%q} %d\n", country, n)
+	}
+	fmt.Fprintln(w, "# HELP torbridges_avg_dial_rtt_ms Average successful dial RTT in milliseconds")
+	fmt.Fprintln(w, "# TYPE torbridges_avg_dial_rtt_ms gauge")
+	fmt.Fprintf(w, "torbridges_avg_dial_rtt_ms %f\n", stats.AvgRTTMillis)
+}
+
+// newPoolMux wires up the -serve HTTP endpoints: /status, /bridges, /bridges.json
+// and /metrics, all backed by pool.
+func newPoolMux(pool *RelayPool, startedAt time.Time) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		stats := pool.Stats()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			UptimeSeconds float64          `json:"uptime_seconds"`
+			Tested        int64            `json:"tested"`
+			Reachable     int64            `json:"reachable"`
+			PerCountry    map[string]int64 `json:"per_country"`
+			AvgRTTMillis  float64          `json:"avg_rtt_ms"`
+		}{time.Since(startedAt).Seconds(), stats.Tested, stats.Reachable, stats.PerCountry, stats.AvgRTTMillis})
+	})
+	mux.HandleFunc("/bridges", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, e := range pool.Snapshot() {
+			fmt.Fprintf(w, "Bridge %s\n", e.Line)
+		}
+	})
+	mux.HandleFunc("/bridges.json", func(w http.ResponseWriter, r *http.Request) {
+		entries := pool.Snapshot()
+		out := make([]jsonRelay, 0, len(entries))
+		for _, e := range entries {
+			out = append(out, jsonRelay{Fingerprint: e.Fingerprint, Address: e.Address, Country: e.Country, RTTMillis: e.RTT.Milliseconds()})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		pool.WritePrometheus(w)
+	})
+	return mux
+}
+
+// generateOutput writes the relay configuration to outfile, either as torrc/plain
+// lines or, in jsonFmt mode, as a JSON array of {fingerprint, address, country, rtt_ms}.
+// It is called with whatever relays were found so far, including on cancellation.
+func generateOutput(workingRelays []Relay, torrcFmt, jsonFmt bool, prefsjs string, outfile *os.File) error {
+	if jsonFmt {
+		var entries []jsonRelay
+		for _, r := range workingRelays {
+			for _, ra := range r.Reachable {
+				entries = append(entries, jsonRelay{
+					Fingerprint: r.Fingerprint,
+					Address:     ra.Address,
+					Country:     r.Country,
+					RTTMillis:   ra.RTT.Milliseconds(),
+				})
+			}
+		}
+		enc := json.NewEncoder(outfile)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(entries); err != nil {
+			return fmt.Errorf("failed to write JSON output: %v", err)
+		}
+	} else {
+		prefix := ""
+		if torrcFmt {
+			prefix = "Bridge "
+		}
+
+		writer := bufio.NewWriter(outfile)
+
+		for _, r := range workingRelays {
+			for _, ra := range r.Reachable {
+				line := fmt.Sprintf("%s%s\n", prefix, relayLine(ra.Address, &r))
+				fmt.Fprint(writer, line)
+				logPrint("Added to output: %s", line)
+			}
+		}
+		if torrcFmt {
+			fmt.Fprintln(writer, "UseBridges 1")
+		}
+		writer.Flush()
 	}
-	writer.Flush()
 
 	if prefsjs != "" {
 		if _, err := os.Stat(prefsjs); os.IsNotExist(err) {
@@ -233,8 +778,8 @@ func generateOutput(workingRelays []Relay, torrcFmt bool, prefsjs string, outfil
 			}
 		}
 		for i, r := range workingRelays {
-			for _, addr := range r.Reachable {
-				newLines = append(newLines, fmt.Sprintf(`user_pref("torbrowser.settings.bridges.bridge_strings.%d", "%s %s");`, i, addr, r.Fingerprint))
+			for _, ra := range r.Reachable {
+				newLines = append(newLines, fmt.Sprintf(`user_pref("torbrowser.settings.bridges.bridge_strings.%d", "%s");`, i, relayLine(ra.Address, &r)))
 			}
 		}
 		newLines = append(newLines, `user_pref("torbrowser.settings.bridges.enabled", true);`)
@@ -265,6 +810,189 @@ func startBrowser() error {
 	return fmt.Errorf("no valid browser executable found")
 }
 
+// scanConfig bundles the scan parameters shared by the one-shot CLI flow and
+// the -serve background rescanner.
+type scanConfig struct {
+	urlList          []string
+	bridgeType       string
+	proxy            string
+	timeout          time.Duration
+	numRelays        int // bounds the checkRelay worker pool
+	goal             int
+	probeCount       int // dials per address; median RTT is used for ranking
+	perCountryMax    int // 0 = unlimited
+	preferredCountry string
+	portList         []string
+	ipv4Only         bool
+	ipv6Only         bool
+}
+
+// probeJob is one (relay, address) pair waiting to be dialed by a worker.
+type probeJob struct {
+	relay *Relay
+	addr  string
+}
+
+// candidatePoolFactor inflates the stop threshold past cfg.goal so selectBest's
+// latency ranking and -per-country-max quota have a meaningfully larger pool of
+// reachable relays to choose from, instead of just the first cfg.goal relays to
+// answer (which leaves nothing for either to actually do).
+const candidatePoolFactor = 5
+
+// scanOnce downloads relays/bridges, filters them, and probes addresses through
+// a bounded pool of cfg.numRelays workers fed from a channel, rather than one
+// goroutine per address, so a chunk with many multi-address relays can't spawn
+// thousands of concurrent dials. It stops feeding new work once
+// cfg.goal*candidatePoolFactor distinct relays have answered, the relay list is
+// exhausted, or ctx is done. Every reachable address is written to bridgesFile
+// immediately and, if pool is non-nil, recorded there too (used by -serve). The
+// returned relays are ranked by latency and trimmed to cfg.goal by selectBest
+// before being handed back.
+func scanOnce(ctx context.Context, cfg scanConfig, dialer Dialer, verifier *CircuitVerifier, bridgesFile *os.File, mu *sync.Mutex, pool *RelayPool) ([]Relay, error) {
+	if cfg.bridgeType != "" {
+		logPrintln("Downloading Tor Bridge information from BridgeDB…")
+	} else {
+		logPrintln("Downloading Tor Relay information from Tor Metrics…")
+	}
+	relays, err := loadRelays(ctx, cfg.urlList, cfg.timeout, cfg.proxy, cfg.bridgeType)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading relays: %v", err)
+	}
+	logPrintln("Done!")
+
+	rand.Shuffle(len(relays), func(i, j int) { relays[i], relays[j] = relays[j], relays[i] })
+	relays = filterAndSortRelays(relays, cfg.preferredCountry, cfg.portList, cfg.ipv4Only, cfg.ipv6Only)
+	if len(relays) == 0 {
+		return nil, fmt.Errorf("no relays match the specified criteria")
+	}
+
+	workerCount := cfg.numRelays
+	if workerCount < 1 {
+		workerCount = 1
+	}
+	logPrint("Testing %d relays with %d workers:\n", len(relays), workerCount)
+
+	jobs := make(chan probeJob)
+	results := make(chan struct {
+		Address string
+		RTT     time.Duration
+		Relay   *Relay
+	}, workerCount*2)
+	stopFeeding := make(chan struct{})
+	var stopOnce sync.Once
+	var dispatched int64
+
+	stopThreshold := cfg.goal * candidatePoolFactor
+	if stopThreshold < cfg.goal {
+		stopThreshold = cfg.goal // overflow guard
+	}
+
+	var workers sync.WaitGroup
+	for w := 0; w < workerCount; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for j := range jobs {
+				checkRelay(ctx, dialer, verifier, j.addr, cfg.timeout, cfg.probeCount, results, j.relay, bridgesFile, mu)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for i := range relays {
+			for _, addr := range relays[i].OrAddresses {
+				select {
+				case jobs <- probeJob{relay: &relays[i], addr: addr}:
+					atomic.AddInt64(&dispatched, 1)
+				case <-stopFeeding:
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	var reachableCount int
+	for res := range results {
+		isNew := len(res.Relay.Reachable) == 0
+		res.Relay.Reachable = append(res.Relay.Reachable, ReachableAddr{Address: res.Address, RTT: res.RTT})
+		if pool != nil {
+			pool.Put(PoolEntry{
+				Fingerprint: res.Relay.Fingerprint,
+				Address:     res.Address,
+				Country:     res.Relay.Country,
+				Line:        relayLine(res.Address, res.Relay),
+				RTT:         res.RTT,
+				LastSeen:    time.Now(),
+			})
+		}
+		logPrint("Reachable: %s %s (%s)\n", res.Address, res.Relay.Fingerprint, res.RTT)
+		if isNew {
+			reachableCount++
+			if reachableCount >= stopThreshold {
+				stopOnce.Do(func() { close(stopFeeding) })
+			}
+		}
+	}
+	if pool != nil {
+		pool.RecordTested(atomic.LoadInt64(&dispatched))
+	}
+
+	var workingRelays []Relay
+	for i := range relays {
+		if len(relays[i].Reachable) > 0 {
+			workingRelays = append(workingRelays, relays[i])
+		}
+	}
+	if ctx.Err() != nil {
+		logPrint("Scan stopped (%v); flushing %d relays found so far\n", ctx.Err(), len(workingRelays))
+	}
+	return selectBest(workingRelays, cfg.goal, cfg.perCountryMax), nil
+}
+
+// selectBest ranks relays by their fastest reachable address (ascending RTT)
+// and returns up to maxResults of them, skipping any relay once perCountryMax
+// relays from its country have already been picked (0 = unlimited). Each
+// returned relay keeps only its single fastest address.
+func selectBest(relays []Relay, maxResults, perCountryMax int) []Relay {
+	type candidate struct {
+		relay *Relay
+		best  ReachableAddr
+	}
+	candidates := make([]candidate, 0, len(relays))
+	for i := range relays {
+		best := relays[i].Reachable[0]
+		for _, ra := range relays[i].Reachable[1:] {
+			if ra.RTT < best.RTT {
+				best = ra
+			}
+		}
+		candidates = append(candidates, candidate{relay: &relays[i], best: best})
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].best.RTT < candidates[j].best.RTT })
+
+	perCountry := make(map[string]int)
+	var selected []Relay
+	for _, c := range candidates {
+		if len(selected) >= maxResults {
+			break
+		}
+		if perCountryMax > 0 && perCountry[c.relay.Country] >= perCountryMax {
+			continue
+		}
+		r := *c.relay
+		r.Reachable = []ReachableAddr{c.best}
+		selected = append(selected, r)
+		perCountry[c.relay.Country]++
+	}
+	return selected
+}
+
 func main() {
 	// Инициализация логгера
 	initLogger()
@@ -280,17 +1008,38 @@ func main() {
 	ports := flag.String("p", "", "Comma-separated list of ports to filter (e.g., 443,9001)")
 	prefsjs := flag.String("browser", "", "Path to prefs.js for Tor Browser")
 	startBrowserFlag := flag.Bool("start-browser", false, "Launch browser after scanning")
+	ipv4Only := flag.Bool("4", false, "Only probe IPv4 addresses")
+	ipv6Only := flag.Bool("6", false, "Only probe IPv6 addresses")
+	bridgeType := flag.String("bridge-type", "", "Fetch pluggable-transport bridges of this type (obfs4, webtunnel, snowflake) from BridgeDB instead of vanilla relays from onionoo")
+	var deadline time.Duration
+	flag.DurationVar(&deadline, "d", 0, "Deadline for the whole scan, e.g. 30s (shorthand for --deadline)")
+	flag.DurationVar(&deadline, "deadline", 0, "Deadline for the whole scan, e.g. 30s; 0 disables")
+	var jsonFmt bool
+	flag.BoolVar(&jsonFmt, "j", false, "Emit JSON instead of torrc lines (shorthand for --json)")
+	flag.BoolVar(&jsonFmt, "json", false, "Emit JSON instead of torrc lines")
+	socksProxy := flag.String("socks", "", "SOCKS5 proxy (host:port) to send probes through, e.g. a local Tor client's SocksPort")
+	verifyCircuit := flag.Bool("verify-circuit", false, "Confirm each reachable relay by building a real Tor circuit through it via an embedded tor")
+	torDataDir := flag.String("tor-data-dir", "", "Data directory for the embedded tor instance used by -verify-circuit")
+	serveAddr := flag.String("serve", "", "Run as a long-lived server on this address (e.g. :8080) instead of scanning once, continuously rescanning and exposing /status, /bridges, /bridges.json and /metrics")
+	rescanInterval := flag.Duration("rescan-interval", 5*time.Minute, "How often to rescan for fresh relays/bridges in -serve mode")
+	poolSize := flag.Int("pool-size", 500, "Maximum reachable relays/bridges to keep in the -serve pool; oldest are evicted once exceeded")
+	probeCount := flag.Int("probe-count", 1, "Dial each address this many times and rank it by the median RTT")
+	perCountryMax := flag.Int("per-country-max", 0, "Max relays from any single country in the final selection; 0 = unlimited")
 	flag.Parse()
 
-	outfile := os.Stdout
-	if *outfileName != "" {
-		f, err := os.Create(*outfileName)
-		if err != nil {
-			logPrint("Failed to create output file: %v\n", err)
-			log.Fatal(err)
-		}
-		defer f.Close()
-		outfile = f
+	if *ipv4Only && *ipv6Only {
+		log.Fatal("-4 and -6 are mutually exclusive")
+	}
+	if *bridgeType != "" && (*preferredCountry != "" || *perCountryMax > 0) {
+		logPrintln("Warning: BridgeDB bridge lines carry no country field, so -bridge-type bunches every bridge into one empty-country bucket; -c and -per-country-max have no useful effect here")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, time.Now().Add(deadline))
+		defer cancel()
 	}
 
 	var portList []string
@@ -308,21 +1057,19 @@ func main() {
 		urlList = append(strings.Split(*urls, ","), urlList...)
 	}
 
-	logPrint("Tor Relay Scanner. Will scan up to %d working relays\n", *goal)
-	logPrintln("Downloading Tor Relay information from Tor Metrics…")
-	relays, err := loadRelays(urlList, time.Duration(*timeout)*time.Second, *proxy)
-	if err != nil {
-		logPrint("Error downloading relays: %v\n", err)
-		log.Fatal(err)
-	}
-	logPrintln("Done!")
-
-	rand.Seed(time.Now().UnixNano())
-	rand.Shuffle(len(relays), func(i, j int) { relays[i], relays[j] = relays[j], relays[i] })
-	relays = filterAndSortRelays(relays, *preferredCountry, portList)
-	if len(relays) == 0 {
-		logPrintln("No relays match the specified criteria")
-		log.Fatal("No relays match the specified criteria")
+	cfg := scanConfig{
+		urlList:          urlList,
+		bridgeType:       *bridgeType,
+		proxy:            *proxy,
+		timeout:          time.Duration(*timeout * float64(time.Second)),
+		numRelays:        *numRelays,
+		goal:             *goal,
+		probeCount:       *probeCount,
+		perCountryMax:    *perCountryMax,
+		preferredCountry: *preferredCountry,
+		portList:         portList,
+		ipv4Only:         *ipv4Only,
+		ipv6Only:         *ipv6Only,
 	}
 
 	// Open the file for appending in real-time
@@ -335,55 +1082,71 @@ func main() {
 
 	var mu sync.Mutex // Mutex to synchronize file writes
 
-	var workingRelays []Relay
-	for i := 0; i < len(relays) && len(workingRelays) < *goal; i += *numRelays {
-		end := i + *numRelays
-		if end > len(relays) {
-			end = len(relays)
-		}
-		chunk := relays[i:end]
-
-		logPrint("\nAttempt %d/%d, Testing %d random relays:\n", (i / *numRelays) + 1, (len(relays) + *numRelays - 1) / *numRelays, len(chunk))
-		for _, r := range chunk {
-			logPrintln(r.Fingerprint)
-		}
-
-		var wg sync.WaitGroup
-		results := make(chan struct {
-			Address string
-			Relay   *Relay
-		}, len(chunk)*10)
-		for _, relay := range chunk {
-			for _, addr := range relay.OrAddresses {
-				wg.Add(1)
-				go checkRelay(addr, time.Duration(*timeout)*time.Second, results, &wg, &relay, bridgesFile, &mu)
-			}
-		}
-		wg.Wait()
-		close(results)
+	rand.Seed(time.Now().UnixNano())
 
-		for res := range results {
-			res.Relay.Reachable = append(res.Relay.Reachable, res.Address)
+	dialer := newDialer(*socksProxy)
+	var verifier *CircuitVerifier
+	if *verifyCircuit {
+		v, err := newCircuitVerifier(ctx, *torDataDir, cfg.timeout)
+		if err != nil {
+			log.Fatal(err)
 		}
+		defer v.Close()
+		verifier = v
+	}
 
-		for _, r := range chunk {
-			if len(r.Reachable) > 0 {
-				workingRelays = append(workingRelays, r)
-			}
-		}
+	logPrint("Tor Relay Scanner. Will report up to %d working relays\n", *goal)
 
-		logPrintln("Reachable relays this attempt:")
-		for _, r := range chunk {
-			if len(r.Reachable) > 0 {
-				for _, addr := range r.Reachable {
-					logPrint("%s %s\n", addr, r.Fingerprint)
+	if *serveAddr != "" {
+		pool := NewRelayPool(*poolSize)
+		startedAt := time.Now()
+
+		go func() {
+			for {
+				if _, err := scanOnce(ctx, cfg, dialer, verifier, bridgesFile, &mu, pool); err != nil {
+					logPrint("Background rescan failed: %v\n", err)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(*rescanInterval):
 				}
 			}
+		}()
+
+		srv := &http.Server{Addr: *serveAddr, Handler: newPoolMux(pool, startedAt)}
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			srv.Shutdown(shutdownCtx)
+		}()
+
+		logPrint("Serving discovered relays on %s (rescanning every %s)\n", *serveAddr, *rescanInterval)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	outfile := os.Stdout
+	if *outfileName != "" {
+		f, err := os.Create(*outfileName)
+		if err != nil {
+			logPrint("Failed to create output file: %v\n", err)
+			log.Fatal(err)
 		}
+		defer f.Close()
+		outfile = f
+	}
+
+	workingRelays, err := scanOnce(ctx, cfg, dialer, verifier, bridgesFile, &mu, nil)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	if len(workingRelays) > 0 {
-		if err := generateOutput(workingRelays, *torrcFmt, *prefsjs, outfile); err != nil {
+		if err := generateOutput(workingRelays, *torrcFmt, jsonFmt, *prefsjs, outfile); err != nil {
 			logPrint("Failed to generate output: %v\n", err)
 			log.Fatal(err)
 		}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestRelayPoolEvictsLeastRecentlySeen(t *testing.T) {
+	pool := NewRelayPool(2)
+
+	pool.Put(PoolEntry{Fingerprint: "a", Address: "192.0.2.1:443", Country: "US"})
+	pool.Put(PoolEntry{Fingerprint: "b", Address: "192.0.2.2:443", Country: "US"})
+	pool.Put(PoolEntry{Fingerprint: "c", Address: "192.0.2.3:443", Country: "DE"})
+
+	snap := pool.Snapshot()
+	if len(snap) != 2 {
+		t.Fatalf("len(snapshot) = %d, want 2 after exceeding maxSize", len(snap))
+	}
+	for _, e := range snap {
+		if e.Fingerprint == "a" {
+			t.Errorf("oldest entry %q should have been evicted, got %+v", "a", snap)
+		}
+	}
+}
+
+func TestRelayPoolPutRefreshesExistingEntry(t *testing.T) {
+	pool := NewRelayPool(2)
+
+	pool.Put(PoolEntry{Fingerprint: "a", Address: "192.0.2.1:443", Country: "US"})
+	pool.Put(PoolEntry{Fingerprint: "b", Address: "192.0.2.2:443", Country: "US"})
+	// Re-seeing "a" should move it to the front, so the next Put evicts "b" instead.
+	pool.Put(PoolEntry{Fingerprint: "a", Address: "192.0.2.1:443", Country: "US"})
+	pool.Put(PoolEntry{Fingerprint: "c", Address: "192.0.2.3:443", Country: "DE"})
+
+	snap := pool.Snapshot()
+	seen := make(map[string]bool, len(snap))
+	for _, e := range snap {
+		seen[e.Fingerprint] = true
+	}
+	if !seen["a"] || seen["b"] {
+		t.Errorf("expected {a, c} to survive and b to be evicted, got %+v", snap)
+	}
+}
+
+func TestRelayPoolStatsTracksPerCountryAndTested(t *testing.T) {
+	pool := NewRelayPool(0)
+
+	pool.Put(PoolEntry{Fingerprint: "a", Address: "192.0.2.1:443", Country: "US"})
+	pool.Put(PoolEntry{Fingerprint: "b", Address: "192.0.2.2:443", Country: "US"})
+	pool.RecordTested(5)
+
+	stats := pool.Stats()
+	if stats.Reachable != 2 {
+		t.Errorf("Reachable = %d, want 2", stats.Reachable)
+	}
+	if stats.PerCountry["US"] != 2 {
+		t.Errorf("PerCountry[US] = %d, want 2", stats.PerCountry["US"])
+	}
+	if stats.Tested != 5 {
+		t.Errorf("Tested = %d, want 5", stats.Tested)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func relayWithRTT(fingerprint, country string, rtt time.Duration) Relay {
+	return Relay{
+		Fingerprint: fingerprint,
+		Country:     country,
+		Reachable:   []ReachableAddr{{Address: "192.0.2.1:443", RTT: rtt}},
+	}
+}
+
+func TestSelectBestRanksByLatency(t *testing.T) {
+	relays := []Relay{
+		relayWithRTT("slow", "US", 300*time.Millisecond),
+		relayWithRTT("fast", "US", 50*time.Millisecond),
+		relayWithRTT("mid", "US", 150*time.Millisecond),
+	}
+
+	got := selectBest(relays, 2, 0)
+
+	if len(got) != 2 {
+		t.Fatalf("len(got) = %d, want 2", len(got))
+	}
+	if got[0].Fingerprint != "fast" || got[1].Fingerprint != "mid" {
+		t.Errorf("got order %q, %q; want fast, mid", got[0].Fingerprint, got[1].Fingerprint)
+	}
+}
+
+func TestSelectBestAppliesPerCountryQuota(t *testing.T) {
+	relays := []Relay{
+		relayWithRTT("us1", "US", 10*time.Millisecond),
+		relayWithRTT("us2", "US", 20*time.Millisecond),
+		relayWithRTT("us3", "US", 30*time.Millisecond),
+		relayWithRTT("de1", "DE", 40*time.Millisecond),
+	}
+
+	got := selectBest(relays, 3, 1)
+
+	if len(got) != 2 {
+		t.Fatalf("len(got) = %d, want 2 (1 US + 1 DE, quota should skip us2/us3)", len(got))
+	}
+	if got[0].Fingerprint != "us1" || got[1].Fingerprint != "de1" {
+		t.Errorf("got %q, %q; want us1, de1", got[0].Fingerprint, got[1].Fingerprint)
+	}
+}
+
+func TestSelectBestKeepsOnlyFastestAddress(t *testing.T) {
+	relay := Relay{
+		Fingerprint: "multi",
+		Country:     "US",
+		Reachable: []ReachableAddr{
+			{Address: "192.0.2.1:443", RTT: 200 * time.Millisecond},
+			{Address: "192.0.2.2:443", RTT: 50 * time.Millisecond},
+		},
+	}
+
+	got := selectBest([]Relay{relay}, 1, 0)
+
+	if len(got) != 1 || len(got[0].Reachable) != 1 {
+		t.Fatalf("got %+v, want a single relay with a single Reachable entry", got)
+	}
+	if got[0].Reachable[0].Address != "192.0.2.2:443" {
+		t.Errorf("kept address %q, want the faster 192.0.2.2:443", got[0].Reachable[0].Address)
+	}
+}
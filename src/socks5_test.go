@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeSocks5Server drives the server half of a SOCKS5 no-auth CONNECT
+// handshake over conn, replying with replyCode to the CONNECT request. Errors
+// are ignored: socks5Connect may return before draining the whole reply (e.g.
+// on a non-zero reply code), in which case this call's final Write blocks
+// until the test closes its end of the pipe and unblocks it.
+func fakeSocks5Server(conn net.Conn, replyCode byte) {
+	greeting := make([]byte, 3)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+		return
+	}
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	hostLen := int(header[4])
+	rest := make([]byte, hostLen+2)
+	if _, err := io.ReadFull(conn, rest); err != nil {
+		return
+	}
+
+	conn.Write([]byte{0x05, replyCode, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+}
+
+func TestSocks5ConnectSuccess(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go fakeSocks5Server(server, 0x00)
+
+	if err := socks5Connect(client, "192.0.2.1:443"); err != nil {
+		t.Fatalf("socks5Connect returned error: %v", err)
+	}
+}
+
+func TestSocks5ConnectFailureCode(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go fakeSocks5Server(server, 0x05) // connection refused
+
+	if err := socks5Connect(client, "192.0.2.1:443"); err == nil {
+		t.Fatal("socks5Connect returned nil error, want one for a non-zero reply code")
+	}
+}
+
+func TestSocks5ConnectInvalidAddress(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	if err := socks5Connect(client, "not-a-valid-address"); err == nil {
+		t.Fatal("socks5Connect returned nil error for an address with no port")
+	}
+}